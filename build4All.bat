@@ -1,7 +1,7 @@
 @echo off
 setlocal enabledelayedexpansion
 
-set SRC=main.go
+set SRC=.
 set OUTDIR=builds
 mkdir %OUTDIR%
 
@@ -4,9 +4,9 @@ go 1.23.0
 
 toolchain go1.24.3
 
-require github.com/BurntSushi/toml v1.2.1
-
 require (
-	golang.org/x/crypto v0.39.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	golang.org/x/crypto v0.39.0
 )
+
+require golang.org/x/sys v0.33.0 // indirect
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -9,22 +13,77 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // Config structures
 
+// SSHJump routes connections to a destination through an SSH jump host.
+// Tunneling is off unless JumpHost is set.
+type SSHJump struct {
+	JumpHost       string `toml:"sshJumpHost,omitempty"` // user@host[:port]
+	KeyFile        string `toml:"sshKeyFile,omitempty"`
+	KeyPassphrase  string `toml:"sshKeyPassphrase,omitempty"`
+	KnownHostsFile string `toml:"sshKnownHostsFile,omitempty"`
+}
+
 type General struct {
-	Listen           string `toml:"listenPort"`
-	MainHostKeyword  string `toml:"mainHostKeyword"`
-	Destination      string `toml:"destination"`
-	SkipCheckTimeout int    `toml:"skipCheckTimeout"` // seconds
+	Listen           string   `toml:"listenPort"`
+	ListenAddresses  []string `toml:"listenAddresses"`   // additional addresses to listen on
+	ListenFailure    string   `toml:"listenFailureMode"` // "fail-fast" or "best-effort"
+	MainHostKeyword  string   `toml:"mainHostKeyword"`
+	Destination      string   `toml:"destination"`
+	SkipCheckTimeout int      `toml:"skipCheckTimeout"`   // seconds
+	WakeMode         string   `toml:"wakeMode"`           // "proxy" or "redirect"
+	RedirectURL      string   `toml:"redirectURL"`        // public URL of destination, for redirect mode
+	WakeTimeout      int      `toml:"wakeTimeout"`        // seconds to wait for destination in redirect mode, and how long a wake is in flight
+	DNSRefresh       int      `toml:"dnsRefreshInterval"` // seconds; 0 uses standard Go resolution
+	StrictReadiness  bool     `toml:"strictReadiness"`
+	MaxLatency       int      `toml:"healthCheckMaxLatency"` // ms; destination slower than this is not ready
+	HeartbeatURL     string   `toml:"heartbeatURL"`          // POSTed periodically for dead-man's-switch monitoring
+	HeartbeatEvery   int      `toml:"heartbeatInterval"`     // seconds
+	CheckInterval    int      `toml:"healthCheckInterval"`   // seconds between background health checks, 0 disables them
+	StartupMode      string   `toml:"startupMode"`           // "sync" or "wait", for backends not checked in the background yet
+	StartupWait      int      `toml:"startupWait"`           // seconds a request waits in "wait" mode
+	Buffering        string   `toml:"responseBuffering"`     // "stream" or "buffer"
+	BufferThreshold  int64    `toml:"bufferThreshold"`       // bytes; larger responses are streamed in buffer mode
+	MetricsListen    string   `toml:"metricsListen"`         // address serving /metrics, empty disables it
+	SSHJump
 }
 
+const (
+	wakeModeProxy    = "proxy"
+	wakeModeRedirect = "redirect"
+)
+
+const (
+	startupSync = "sync"
+	startupWait = "wait"
+)
+
+const (
+	bufferingStream = "stream"
+	bufferingBuffer = "buffer"
+)
+
+const (
+	listenFailFast   = "fail-fast"
+	listenBestEffort = "best-effort"
+)
+
 type Target struct {
 	Destination  string   `toml:"destination"`
 	MacAddress   string   `toml:"macAddress"`
@@ -33,6 +92,57 @@ type Target struct {
 	WOL          bool     `toml:"wolEnable"`
 	IgnoredHosts []string `toml:"ignoredHosts"`
 	IgnoredPaths []string `toml:"ignoredPaths"`
+	MaxLatency   int      `toml:"healthCheckMaxLatency"` // ms; 0 means no constraint
+	MaxWakes     int      `toml:"maxConcurrentWakes"`    // wakes in flight at once, default 1
+	Cooldown     int      `toml:"wakeCooldown"`          // seconds between WoL packets, used until boot history exists
+	Adaptive     bool     `toml:"adaptiveCooldown"`      // derive the cooldown from observed boot times
+	CooldownMult float64  `toml:"cooldownMultiplier"`    // times the average boot time, default 1.5
+	CooldownMin  int      `toml:"cooldownMin"`           // seconds
+	CooldownMax  int      `toml:"cooldownMax"`           // seconds, 0 means no ceiling
+	WakeGroup    string   `toml:"wakeGroup"`             // backends on the same machine share one wake
+	Hosts        []string `toml:"hosts"`                 // request hosts routed to this backend
+	RedirectURL  string   `toml:"redirectURL"`           // public URL of this backend, for redirect mode
+	SSHJump
+
+	hosts        matchSet
+	ignoredHosts matchSet
+	ignoredPaths matchSet
+}
+
+// matchSet holds a list of host or path entries split into exact values,
+// looked up in constant time, and glob patterns, tried in config order.
+type matchSet struct {
+	exact    map[string]struct{}
+	patterns []string
+}
+
+// newMatchSet builds a matchSet. Entries containing any of *?[ are also
+// tried as path.Match globs, so a malformed one is an error rather than an
+// entry that silently never matches.
+func newMatchSet(entries []string) (matchSet, error) {
+	m := matchSet{exact: make(map[string]struct{}, len(entries))}
+	for _, e := range entries {
+		m.exact[e] = struct{}{}
+		if strings.ContainsAny(e, "*?[") {
+			if _, err := path.Match(e, ""); err != nil {
+				return matchSet{}, fmt.Errorf("invalid pattern %q: %w", e, err)
+			}
+			m.patterns = append(m.patterns, e)
+		}
+	}
+	return m, nil
+}
+
+func (m matchSet) match(s string) bool {
+	if _, ok := m.exact[s]; ok {
+		return true
+	}
+	for _, p := range m.patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
 }
 
 type Config struct {
@@ -44,170 +154,1922 @@ type Config struct {
 
 type backendState struct {
 	lastOnline time.Time
+	lastDown   time.Time // last failed probe
 	mu         sync.Mutex
+	health     healthCheck
+	wake       *wakeState
+	proxied    bool          // requests are proxied to it, see strictReadiness
+	checked    chan struct{} // closed after the first background check, nil without them
+}
+
+// wakeState tracks waking one machine. Backends sharing a wakeGroup share
+// their wakeState, so waking any of them counts as waking all of them.
+type wakeState struct {
+	mu          sync.Mutex
+	wakes       *wakeLimiter    // caps wakes in flight
+	wakeStarted time.Time       // first packet of the current wake, zero if not waking
+	lastPacket  time.Time       // most recent packet
+	bootTimes   []time.Duration // recent wake-to-online durations, oldest first
+}
+
+// wakeLimiter caps the wakes in flight for one machine. A wake is in flight
+// from its packet until the machine is seen online or its hold time passes.
+type wakeLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	held []*wakeSlot
+}
+
+type wakeSlot struct {
+	timer *time.Timer
+}
+
+func newWakeLimiter(max int) *wakeLimiter {
+	return &wakeLimiter{max: max}
 }
 
-var backendStates = map[string]*backendState{}
+// acquire claims a slot for hold, or reports false if all are taken. The
+// returned func gives the slot back early.
+func (l *wakeLimiter) acquire(hold time.Duration) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.held) >= l.max {
+		return nil, false
+	}
+	slot := &wakeSlot{}
+	slot.timer = time.AfterFunc(hold, func() { l.release(slot) })
+	l.held = append(l.held, slot)
+	return func() { l.release(slot) }, true
+}
+
+func (l *wakeLimiter) release(slot *wakeSlot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot.timer.Stop()
+	l.held = slices.DeleteFunc(l.held, func(s *wakeSlot) bool { return s == slot })
+}
+
+// releaseAll ends every wake in flight, once the machine is up.
+func (l *wakeLimiter) releaseAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, slot := range l.held {
+		slot.timer.Stop()
+	}
+	l.held = nil
+}
+
+// wakeKey identifies the wakeState of a backend.
+func wakeKey(name string, backend Target) string {
+	if backend.WakeGroup != "" {
+		return "group:" + backend.WakeGroup
+	}
+	return "backend:" + name
+}
+
+// bootHistory is how many recent boot times are kept per backend. Wakes
+// taking longer than maxBootTime are assumed to have failed and came up for
+// another reason, so they are not recorded. Neither are wakes where the
+// backend was last seen down more than bootSampleWindow before it was seen
+// up: it may have been up long before anyone looked.
+const (
+	bootHistory      = 10
+	maxBootTime      = 30 * time.Minute
+	bootSampleWindow = time.Minute
+)
+
+// dnsResolver is set when periodic re-resolution of destinations is enabled.
+var dnsResolver *refreshingResolver
 
 // Load config
 
-func LoadConfig(filename string) (*Config, error) {
+// profileEnv selects a config profile when the -profile flag is not given.
+const profileEnv = "WOL_PROXY_PROFILE"
+
+// LoadConfig reads filename and, if profile is set, merges the matching
+// [profiles.<name>] section over the base config. Tables are merged key by
+// key, so a profile can override a single field of one backend or add a new
+// backend; any other value, arrays included, is replaced as a whole.
+func LoadConfig(filename, profile string) (*Config, error) {
 	var cfg Config
-	if _, err := toml.DecodeFile(filename, &cfg); err != nil {
+	if profile == "" {
+		// [profiles] is not a Config field, so it is ignored here
+		if _, err := toml.DecodeFile(filename, &cfg); err != nil {
+			return nil, err
+		}
+	} else if err := decodeProfile(filename, profile, &cfg); err != nil {
 		return nil, err
 	}
 
-	for name := range cfg.Backends {
-		backendStates[name] = &backendState{}
+	if err := cfg.applyDefaults(); err != nil {
+		return nil, err
+	}
+	for name, backend := range cfg.Backends {
+		if backend.MaxWakes <= 0 {
+			backend.MaxWakes = 1
+		}
+		if backend.CooldownMult <= 0 {
+			backend.CooldownMult = 1.5
+		}
+		hosts := make([]string, len(backend.Hosts))
+		for i, h := range backend.Hosts {
+			hosts[i] = strings.ToLower(h)
+		}
+		var err error
+		if backend.hosts, err = newMatchSet(hosts); err != nil {
+			return nil, fmt.Errorf("backend %s: hosts: %w", name, err)
+		}
+		if backend.ignoredHosts, err = newMatchSet(backend.IgnoredHosts); err != nil {
+			return nil, fmt.Errorf("backend %s: ignoredHosts: %w", name, err)
+		}
+		if backend.ignoredPaths, err = newMatchSet(backend.IgnoredPaths); err != nil {
+			return nil, fmt.Errorf("backend %s: ignoredPaths: %w", name, err)
+		}
+		cfg.Backends[name] = backend
+	}
+	if err := checkWakeGroups(cfg.Backends); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
-// Utils
+// checkWakeGroups rejects wake groups whose members disagree on how the
+// machine is woken. Any member may send the group's packet, so they must all
+// send the same one under the same cooldown.
+func checkWakeGroups(backends map[string]Target) error {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-func checkHealth(url string) bool {
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		return false
+	first := map[string]string{}
+	for _, name := range names {
+		backend := backends[name]
+		if backend.WakeGroup == "" {
+			continue
+		}
+		other, ok := first[backend.WakeGroup]
+		if !ok {
+			first[backend.WakeGroup] = name
+			continue
+		}
+		if key := wakeSettingDiff(backends[other], backend); key != "" {
+			return fmt.Errorf("backend %s: wakeGroup %q: %s differs from backend %s", name, backend.WakeGroup, key, other)
+		}
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
+	return nil
 }
 
-func sendWOL(macAddr, broadcastIP string, port int) error {
-	mac, err := net.ParseMAC(macAddr)
-	if err != nil {
-		return fmt.Errorf("invalid MAC: %w", err)
+// wakeSettingDiff returns the first wake setting a and b differ in, or "".
+func wakeSettingDiff(a, b Target) string {
+	switch {
+	case !strings.EqualFold(a.MacAddress, b.MacAddress):
+		return "macAddress"
+	case a.BroadcastIP != b.BroadcastIP:
+		return "broadcastIP"
+	case a.WolPort != b.WolPort:
+		return "wolPort"
+	case a.MaxWakes != b.MaxWakes:
+		return "maxConcurrentWakes"
+	case a.Cooldown != b.Cooldown:
+		return "wakeCooldown"
+	case a.Adaptive != b.Adaptive:
+		return "adaptiveCooldown"
+	case a.CooldownMult != b.CooldownMult:
+		return "cooldownMultiplier"
+	case a.CooldownMin != b.CooldownMin:
+		return "cooldownMin"
+	case a.CooldownMax != b.CooldownMax:
+		return "cooldownMax"
 	}
-	packet := make([]byte, 102)
-	for i := 0; i < 6; i++ {
-		packet[i] = 0xFF
+	return ""
+}
+
+func (cfg *Config) applyDefaults() error {
+	g := &cfg.General
+	if g.Listen == "" && len(g.ListenAddresses) == 0 {
+		g.Listen = ":8080"
 	}
-	for i := 6; i < 102; i += 6 {
-		copy(packet[i:], mac)
+	if g.HeartbeatEvery == 0 {
+		g.HeartbeatEvery = 60
 	}
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", broadcastIP, port))
-	if err != nil {
+	if g.HeartbeatURL != "" && g.HeartbeatEvery < 0 {
+		return fmt.Errorf("heartbeatInterval must be positive, got %d", g.HeartbeatEvery)
+	}
+	if g.ListenFailure == "" {
+		g.ListenFailure = listenFailFast
+	}
+	if g.ListenFailure != listenFailFast && g.ListenFailure != listenBestEffort {
+		return fmt.Errorf("unknown listenFailureMode %q", g.ListenFailure)
+	}
+	if g.StartupMode == "" {
+		g.StartupMode = startupSync
+	}
+	if g.StartupMode != startupSync && g.StartupMode != startupWait {
+		return fmt.Errorf("unknown startupMode %q", g.StartupMode)
+	}
+	if g.StartupWait == 0 {
+		g.StartupWait = 5
+	}
+	if g.Buffering == "" {
+		g.Buffering = bufferingStream
+	}
+	if g.Buffering != bufferingStream && g.Buffering != bufferingBuffer {
+		return fmt.Errorf("unknown responseBuffering %q", g.Buffering)
+	}
+	if g.BufferThreshold == 0 {
+		g.BufferThreshold = 64 << 10
+	}
+	if g.SkipCheckTimeout == 0 {
+		g.SkipCheckTimeout = 30
+	}
+	if g.WakeMode == "" {
+		g.WakeMode = wakeModeProxy
+	}
+	if g.WakeTimeout == 0 {
+		g.WakeTimeout = 60
+	}
+	if g.WakeMode != wakeModeProxy && g.WakeMode != wakeModeRedirect {
+		return fmt.Errorf("unknown wakeMode %q", g.WakeMode)
+	}
+
+	// The [proxy] destination may only be left out when backends route
+	// their own hosts
+	routed := false
+	for name, backend := range cfg.Backends {
+		if name == destinationName {
+			return fmt.Errorf("backend name %q is reserved for the [proxy] destination in metrics", name)
+		}
+		if _, err := parseDestination(backend.Destination); err != nil {
+			return fmt.Errorf("backend %s: destination: %w", name, err)
+		}
+		// A relative redirectURL would send clients back to the proxy
+		if backend.RedirectURL != "" {
+			if _, err := parseDestination(backend.RedirectURL); err != nil {
+				return fmt.Errorf("backend %s: redirectURL: %w", name, err)
+			}
+		}
+		if len(backend.Hosts) == 0 {
+			// Only routed backends are ever redirected to
+			if backend.RedirectURL != "" {
+				return fmt.Errorf("backend %s: redirectURL requires hosts", name)
+			}
+			continue
+		}
+		routed = true
+		if g.WakeMode == wakeModeRedirect && backend.RedirectURL == "" && g.RedirectURL == "" {
+			return fmt.Errorf("backend %s: wakeMode %q requires redirectURL", name, wakeModeRedirect)
+		}
+	}
+	if g.RedirectURL != "" {
+		if _, err := parseDestination(g.RedirectURL); err != nil {
+			return fmt.Errorf("proxy: redirectURL: %w", err)
+		}
+	}
+	if g.Destination != "" || !routed {
+		if _, err := parseDestination(g.Destination); err != nil {
+			return fmt.Errorf("proxy: destination: %w", err)
+		}
+		if g.WakeMode == wakeModeRedirect && g.RedirectURL == "" {
+			return fmt.Errorf("wakeMode %q requires redirectURL", wakeModeRedirect)
+		}
+	}
+	return nil
+}
+
+// decodeProfile decodes filename with the given profile merged over it into
+// cfg. The merged tables are re-encoded before decoding, so decode errors
+// can only point at lines of the merged config.
+func decodeProfile(filename, profile string, cfg *Config) error {
+	raw := map[string]interface{}{}
+	if _, err := toml.DecodeFile(filename, &raw); err != nil {
 		return err
 	}
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
+	profiles, _ := raw["profiles"].(map[string]interface{})
+	delete(raw, "profiles")
+	overrides, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("profile %q not found", profile)
+	}
+	mergeTables(raw, overrides)
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
 		return err
 	}
-	defer conn.Close()
-	_, err = conn.Write(packet)
-	return err
+	if _, err := toml.Decode(buf.String(), cfg); err != nil {
+		return fmt.Errorf("%s with profile %q (line numbers refer to the merged config): %w", filename, profile, err)
+	}
+	return nil
 }
 
-func makeProxy(targetURL string) http.Handler {
-	u, _ := url.Parse(targetURL)
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("proxy error: %v", err)
-		http.Error(w, "backend unavailable", http.StatusBadGateway)
+func mergeTables(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcTable, srcOK := value.(map[string]interface{})
+		dstTable, dstOK := dst[key].(map[string]interface{})
+		if srcOK && dstOK {
+			mergeTables(dstTable, srcTable)
+			continue
+		}
+		dst[key] = value
 	}
-	return proxy
 }
 
-func recentlyOnline(state *backendState, timeout time.Duration) bool {
-	state.mu.Lock()
-	defer state.mu.Unlock()
-	return !state.lastOnline.IsZero() && time.Since(state.lastOnline) < timeout
+// Config dump
+
+const redacted = "xxxxx"
+
+// redactURL masks any password embedded in the userinfo of a URL and every
+// query value, since tokens are often passed as ?api_key=... Values that
+// cannot be parsed are masked entirely since we cannot tell which part of
+// them is sensitive.
+func redactURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<unparseable url " + redacted + ">"
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for key, values := range q {
+			for i := range values {
+				values[i] = redacted
+			}
+			q[key] = values
+		}
+		u.RawQuery = q.Encode()
+	}
+	if u.Fragment != "" {
+		u.Fragment = redacted
+	}
+	return u.Redacted()
 }
 
-func setOnline(state *backendState) {
-	state.mu.Lock()
-	state.lastOnline = time.Now()
-	state.mu.Unlock()
+// redactURLPath masks everything after the host, for URLs such as ping
+// endpoints where the path itself is the credential.
+func redactURLPath(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<unparseable url " + redacted + ">"
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + redacted}).String()
 }
 
-func shouldSendWOL(backend Target, host, path string) bool {
-	if !backend.WOL {
-		return false
+func redactSSHJump(j SSHJump) SSHJump {
+	if j.KeyPassphrase != "" {
+		j.KeyPassphrase = redacted
 	}
-	for _, h := range backend.IgnoredHosts {
-		if h == host {
-			return false
-		}
+	return j
+}
+
+// redactConfig returns a deep copy of cfg with all secrets masked.
+func redactConfig(cfg *Config) Config {
+	out := *cfg
+	out.General.Destination = redactURL(cfg.General.Destination)
+	out.General.RedirectURL = redactURL(cfg.General.RedirectURL)
+	out.General.HeartbeatURL = redactURLPath(cfg.General.HeartbeatURL)
+	out.General.SSHJump = redactSSHJump(cfg.General.SSHJump)
+	out.Backends = make(map[string]Target, len(cfg.Backends))
+	for name, backend := range cfg.Backends {
+		backend.Destination = redactURL(backend.Destination)
+		backend.RedirectURL = redactURL(backend.RedirectURL)
+		backend.SSHJump = redactSSHJump(backend.SSHJump)
+		out.Backends[name] = backend
 	}
-	for _, p := range backend.IgnoredPaths {
-		if p == path {
-			return false
-		}
+	return out
+}
+
+func dumpConfig(cfg *Config) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(redactConfig(cfg)); err != nil {
+		return "", err
 	}
-	return true
+	return buf.String(), nil
 }
 
-// Handler
+// SSH tunneling
 
-func handler(cfg *Config) http.HandlerFunc {
-	skipTimeout := time.Duration(cfg.General.SkipCheckTimeout) * time.Second
-	proxy := makeProxy(cfg.General.Destination)
+type sshDialer struct {
+	addr   string
+	config *ssh.ClientConfig
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		clientIP := r.RemoteAddr
-		host := r.Host
-		path := r.URL.Path
-		log.Printf("[%s] Request host=%s path=%s", clientIP, host, path)
+	mu      sync.Mutex
+	client  *ssh.Client
+	pending *sshConnect // connection being established, nil if none
+	probing bool        // a keepalive is checking client, see checkAlive
+	closed  bool        // set by close, no more connections are made
+}
 
-		if !strings.Contains(host, cfg.General.MainHostKeyword) {
-			io.WriteString(w, "Host does not match main backend target")
-			return
-		}
+// sshConnect is one attempt to connect to the jump host, shared by every
+// dial waiting for it.
+type sshConnect struct {
+	done   chan struct{} // closed once client or err is set
+	client *ssh.Client
+	err    error
+}
 
-		// Check backends and send WoL
-		for name, backend := range cfg.Backends {
-			state := backendStates[name]
-			up := false
+func newSSHDialer(j SSHJump) (*sshDialer, error) {
+	user, addr, ok := strings.Cut(j.JumpHost, "@")
+	if !ok || user == "" || addr == "" {
+		return nil, fmt.Errorf("sshJumpHost must be user@host[:port], got %q", j.JumpHost)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	if j.KeyFile == "" {
+		return nil, errors.New("sshKeyFile is required when sshJumpHost is set")
+	}
+	if j.KnownHostsFile == "" {
+		return nil, errors.New("sshKnownHostsFile is required when sshJumpHost is set")
+	}
 
-			if recentlyOnline(state, skipTimeout) {
-				up = true
-			} else if checkHealth(backend.Destination) {
-				up = true
-				setOnline(state)
-			}
+	key, err := os.ReadFile(j.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ssh key: %w", err)
+	}
+	var signer ssh.Signer
+	if j.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(j.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh key: %w", err)
+	}
+	hostKeyCallback, err := knownhosts.New(j.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
 
-			if !up && shouldSendWOL(backend, host, path) {
-				log.Printf("Backend %s down -> sending WoL", name)
-				if err := sendWOL(backend.MacAddress, backend.BroadcastIP, backend.WolPort); err != nil {
-					log.Printf("WOL %s failed: %v", name, err)
-				}
-			}
-		}
+	return &sshDialer{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+	}, nil
+}
+
+// connect returns the shared SSH client, establishing it if needed. Only one
+// connection attempt runs at a time; concurrent callers wait for it until
+// their ctx is done.
+func (d *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, errors.New("ssh tunnel closed")
+	}
+	if d.client != nil {
+		client := d.client
+		d.mu.Unlock()
+		return client, nil
+	}
+	attempt := d.pending
+	if attempt == nil {
+		attempt = &sshConnect{done: make(chan struct{})}
+		d.pending = attempt
+		go d.establish(attempt)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.client, attempt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// establish connects to the jump host for attempt. It is not tied to the
+// context of any one request, so the dial and handshake are bounded by the
+// configured timeout instead; ssh.NewClientConn applies none by itself.
+func (d *sshDialer) establish(attempt *sshConnect) {
+	client, err := d.dial()
+
+	d.mu.Lock()
+	d.pending = nil
+	if err == nil && d.closed {
+		client.Close()
+		client, err = nil, errors.New("ssh tunnel closed")
+	}
+	if err == nil {
+		d.client = client
+	}
+	d.mu.Unlock()
+
+	attempt.client, attempt.err = client, err
+	close(attempt.done)
+}
+
+func (d *sshDialer) dial() (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", d.addr, d.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(d.config.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s: %w", d.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// drop discards client if it is still the shared one so the next dial
+// reconnects.
+func (d *sshDialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
 
-		// Always forward request to main service, if up
-		if checkHealth(cfg.General.Destination) {
-			proxy.ServeHTTP(w, r)
+// close shuts down the shared SSH client, if any, and any tunneled
+// connections with it.
+func (d *sshDialer) close() {
+	d.mu.Lock()
+	client := d.client
+	d.client = nil
+	d.closed = true
+	d.mu.Unlock()
+	if client != nil {
+		client.Close()
+	}
+}
+
+// checkAlive sends a keepalive over client and drops it unless the jump
+// host answers within the connect timeout.
+func (d *sshDialer) checkAlive(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client != client || d.probing {
+		d.mu.Unlock()
+		return
+	}
+	d.probing = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.probing = false
+		d.mu.Unlock()
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		// Any reply, even a refusal, means the tunnel is alive
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
 			return
 		}
+		log.Printf("SSH keepalive to %s failed: %v, reconnecting", d.addr, err)
+	case <-time.After(d.config.Timeout):
+		log.Printf("SSH keepalive to %s timed out, reconnecting", d.addr)
+	}
+	d.drop(client)
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+	// The jump host refusing the forward, e.g. because the backend is
+	// asleep, says nothing about the tunnel itself
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return nil, err
+	}
+	// A timed out forward may mean the tunnel is half dead, which TCP can
+	// take many minutes to notice
+	if ctx.Err() != nil {
+		go d.checkAlive(client)
+		return nil, err
+	}
 
-		http.Error(w, "Destination backend unavailable", http.StatusServiceUnavailable)
+	// The tunnel may have gone stale, retry once on a fresh connection.
+	d.drop(client)
+	if client, err = d.connect(ctx); err != nil {
+		return nil, err
 	}
+	return client.DialContext(ctx, network, addr)
 }
 
-// Main
+// DNS re-resolution
 
-func main() {
-	configFile := "config.toml"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+// refreshingResolver caches the addresses of dialed hosts and re-resolves
+// them every interval. When a host's addresses change, idle keep-alive
+// connections are closed so new requests follow the new address.
+type refreshingResolver struct {
+	interval time.Duration
+	dialer   net.Dialer
+
+	mu         sync.Mutex
+	hosts      map[string][]string
+	transports []*http.Transport
+}
+
+func newRefreshingResolver(interval time.Duration) *refreshingResolver {
+	return &refreshingResolver{
+		interval: interval,
+		dialer:   net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		hosts:    map[string][]string{},
+	}
+}
+
+func (r *refreshingResolver) track(t *http.Transport) {
+	r.mu.Lock()
+	r.transports = append(r.transports, t)
+	r.mu.Unlock()
+}
+
+func (r *refreshingResolver) untrack(t *http.Transport) {
+	r.mu.Lock()
+	r.transports = slices.DeleteFunc(r.transports, func(tracked *http.Transport) bool { return tracked == t })
+	r.mu.Unlock()
+}
+
+func (r *refreshingResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	addrs, ok := r.hosts[host]
+	r.mu.Unlock()
+	if ok {
+		return addrs, nil
 	}
 
-	cfg, err := LoadConfig(configFile)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
 	if err != nil {
-		log.Fatalf("Failed to load config file: %v", err)
+		return nil, err
+	}
+	r.mu.Lock()
+	r.hosts[host] = addrs
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+func (r *refreshingResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
+
+func (r *refreshingResolver) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.refresh()
+	}
+}
+
+func (r *refreshingResolver) refresh() {
+	r.mu.Lock()
+	hosts := make([]string, 0, len(r.hosts))
+	for host := range r.hosts {
+		hosts = append(hosts, host)
 	}
+	r.mu.Unlock()
+
+	changed := false
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			// Keep the last known addresses, the host may just be asleep
+			log.Printf("DNS refresh of %s failed: %v", host, err)
+			continue
+		}
 
-	if cfg.General.Listen == "" {
-		cfg.General.Listen = ":8080"
+		r.mu.Lock()
+		old := r.hosts[host]
+		r.hosts[host] = addrs
+		r.mu.Unlock()
+		if !sameAddrs(old, addrs) {
+			log.Printf("DNS %s changed %v -> %v", host, old, addrs)
+			changed = true
+		}
 	}
-	if cfg.General.SkipCheckTimeout == 0 {
-		cfg.General.SkipCheckTimeout = 30
+
+	if changed {
+		r.mu.Lock()
+		transports := r.transports
+		r.mu.Unlock()
+		for _, t := range transports {
+			t.CloseIdleConnections()
+		}
 	}
+}
 
-	http.HandleFunc("/", handler(cfg))
-	log.Printf("Proxy listening on %s", cfg.General.Listen)
-	log.Fatal(http.ListenAndServe(cfg.General.Listen, nil))
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, addr := range a {
+		seen[addr] = true
+	}
+	for _, addr := range b {
+		if !seen[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// newTransport returns the transport used to reach a destination, dialing
+// through the configured SSH jump host if any. Tunneled destinations are
+// resolved by the jump host, so DNS refresh only applies to direct ones.
+// The returned func, nil for the shared default transport, releases the
+// transport's connections once nothing uses it anymore.
+func newTransport(j SSHJump) (http.RoundTripper, func(), error) {
+	if j.JumpHost == "" {
+		if dnsResolver == nil {
+			return http.DefaultTransport, nil, nil
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dnsResolver.DialContext
+		dnsResolver.track(transport)
+		resolver := dnsResolver
+		return transport, func() {
+			resolver.untrack(transport)
+			transport.CloseIdleConnections()
+		}, nil
+	}
+	d, err := newSSHDialer(j)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = d.DialContext
+	return transport, func() {
+		transport.CloseIdleConnections()
+		d.close()
+	}, nil
+}
+
+// Utils
+
+func newHealthClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{Timeout: 3 * time.Second, Transport: transport}
+}
+
+// destinationName labels health checks of the proxied destination.
+const destinationName = "destination"
+
+type healthCheck struct {
+	name       string
+	client     *http.Client
+	url        string
+	maxLatency time.Duration // 0 means no constraint
+}
+
+// check reports whether the destination is ready. A check that succeeds but
+// takes longer than maxLatency counts as not ready yet.
+func (h healthCheck) check() bool {
+	start := time.Now()
+	ok := checkHealth(h.client, h.url)
+	elapsed := time.Since(start)
+
+	result := "failure"
+	if ok {
+		result = "success"
+		if h.maxLatency > 0 && elapsed > h.maxLatency {
+			log.Printf("Health check %s took %v (max %v) -> not ready", h.name, elapsed, h.maxLatency)
+			result = "slow"
+			ok = false
+		}
+	}
+	metrics.observeHealthCheck(h.name, result, elapsed)
+	return ok
+}
+
+func checkHealth(client *http.Client, url string) bool {
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func sendWOL(macAddr, broadcastIP string, port int) error {
+	mac, err := net.ParseMAC(macAddr)
+	if err != nil {
+		return fmt.Errorf("invalid MAC: %w", err)
+	}
+	packet := make([]byte, 102)
+	for i := 0; i < 6; i++ {
+		packet[i] = 0xFF
+	}
+	for i := 6; i < 102; i += 6 {
+		copy(packet[i:], mac)
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(broadcastIP, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	// Sending to a broadcast address needs SO_BROADCAST. The net package
+	// mostly sets it already, set it explicitly so wakes don't depend on that.
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setBroadcast(fd) }); err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("set SO_BROADCAST: %w", serr)
+			}
+			return nil
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(packet, addr); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("sending to %s not permitted, check that it is a broadcast address of this host and that no firewall blocks it: %w", addr, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// parseDestination parses a destination URL, which must be absolute.
+func parseDestination(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: must be an absolute URL like http://host:port", raw)
+	}
+	return u, nil
+}
+
+// makeProxy builds the reverse proxy for targetURL. If bufferLimit is
+// positive, responses of unknown length up to that size are buffered, see
+// bufferResponse. If onResult is set it is told whether each proxied request
+// reached a working service.
+func makeProxy(targetURL string, transport http.RoundTripper, bufferLimit int64, onResult func(ok bool)) (http.Handler, error) {
+	u, err := parseDestination(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("proxy error: %v", err)
+		if onResult != nil {
+			onResult(false)
+		}
+		http.Error(w, "backend unavailable", http.StatusBadGateway)
+	}
+	if onResult != nil || bufferLimit > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if onResult != nil {
+				onResult(resp.StatusCode < 500)
+			}
+			if bufferLimit > 0 {
+				return bufferResponse(resp, bufferLimit)
+			}
+			return nil
+		}
+	}
+	return proxy, nil
+}
+
+// bufferResponse reads a response of unknown length into memory if it fits
+// in limit bytes, so it is sent with a Content-Length instead of chunked.
+// Bigger responses, event streams and upgrades keep streaming. Responses to
+// HEAD have no body to measure and ones announcing trailers need chunked
+// encoding to send them, so both are passed through as they are.
+func bufferResponse(resp *http.Response, limit int64) error {
+	if resp.ContentLength >= 0 || resp.StatusCode == http.StatusSwitchingProtocols ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) || len(resp.Trailer) > 0 {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		// Too big, stream the rest after what was already read
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return nil
+	}
+
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// sameOrigin reports whether two URLs point at the same scheme and host.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// waitHealthy polls h until it reports healthy, timeout elapses or ctx is
+// done.
+func waitHealthy(ctx context.Context, h healthCheck, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if h.check() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func redirectTarget(base string, r *http.Request) string {
+	return strings.TrimSuffix(base, "/") + r.URL.RequestURI()
+}
+
+func recentlyOnline(state *backendState, timeout time.Duration) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return !state.lastOnline.IsZero() && time.Since(state.lastOnline) < timeout
+}
+
+// checkedDown reports whether the last probe of state failed within timeout.
+func checkedDown(state *backendState, timeout time.Duration) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.lastDown.After(state.lastOnline) && time.Since(state.lastDown) < timeout
+}
+
+// setOnline caches state as online and, if it was being woken, records how
+// long the boot took.
+func setOnline(state *backendState) {
+	now := time.Now()
+	state.mu.Lock()
+	state.lastOnline = now
+	seenDown := !state.lastDown.IsZero() && now.Sub(state.lastDown) <= bootSampleWindow
+	state.mu.Unlock()
+
+	ws := state.wake
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.wakeStarted.IsZero() {
+		if boot := now.Sub(ws.wakeStarted); seenDown && boot <= maxBootTime {
+			ws.bootTimes = append(ws.bootTimes, boot)
+			if len(ws.bootTimes) > bootHistory {
+				ws.bootTimes = ws.bootTimes[1:]
+			}
+		}
+		ws.wakeStarted = time.Time{}
+	}
+	ws.wakes.releaseAll()
+}
+
+func setOffline(state *backendState) {
+	state.mu.Lock()
+	state.lastOnline = time.Time{}
+	state.mu.Unlock()
+}
+
+// probe health checks a backend that is not cached as online and caches it
+// if it is up. With strict readiness a proxied backend is only cached by a
+// successful proxied request, and any other must pass a second check.
+func probe(state *backendState, strict bool) bool {
+	if !state.health.check() {
+		state.mu.Lock()
+		state.lastDown = time.Now()
+		state.mu.Unlock()
+		return false
+	}
+	if !strict || (!state.proxied && confirmHealthy(state.health)) {
+		setOnline(state)
+	}
+	return true
+}
+
+// confirmHealthy re-checks a backend that just passed a health check, so a
+// machine that answers once while still booting is not cached as online.
+func confirmHealthy(h healthCheck) bool {
+	time.Sleep(500 * time.Millisecond)
+	return h.check()
+}
+
+// Wake decisions, recorded per backend and request in wol_decision_total
+const (
+	decisionWoken          = "woken"
+	decisionCachedOnline   = "cached_online"
+	decisionOnline         = "online"
+	decisionWOLDisabled    = "wol_disabled"
+	decisionIgnoredHost    = "suppressed_ignored_host"
+	decisionIgnoredPath    = "suppressed_ignored_path"
+	decisionWakeGroup      = "suppressed_wake_group"
+	decisionCooldown       = "suppressed_cooldown"
+	decisionMaxConcurrency = "suppressed_max_concurrent"
+	decisionWOLFailed      = "wol_failed"
+)
+
+// suppressWOL returns why a down backend must not be woken for this request,
+// or "" if it should be.
+func suppressWOL(backend Target, host, path string) string {
+	switch {
+	case !backend.WOL:
+		return decisionWOLDisabled
+	case backend.ignoredHosts.match(host):
+		return decisionIgnoredHost
+	case backend.ignoredPaths.match(path):
+		return decisionIgnoredPath
+	}
+	return ""
+}
+
+// Metrics
+
+// healthCheckBuckets are the upper bounds, in seconds, of the health check
+// duration histogram. Checks time out after 3s.
+var healthCheckBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 3}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range healthCheckBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type healthCheckKey struct {
+	backend string
+	result  string
+}
+
+type decisionKey struct {
+	backend  string
+	decision string
+}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	healthChecks map[healthCheckKey]*histogram
+	decisions    map[decisionKey]uint64
+}
+
+var metrics = &metricsRegistry{
+	healthChecks: map[healthCheckKey]*histogram{},
+	decisions:    map[decisionKey]uint64{},
+}
+
+func (m *metricsRegistry) countDecision(backend, decision string) {
+	m.mu.Lock()
+	m.decisions[decisionKey{backend: backend, decision: decision}]++
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) observeHealthCheck(backend, result string, d time.Duration) {
+	key := healthCheckKey{backend: backend, result: result}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.healthChecks[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(healthCheckBuckets))}
+		m.healthChecks[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// snapshot copies all metrics so they can be written out without holding
+// m.mu, which every proxied request needs.
+func (m *metricsRegistry) snapshot() (map[healthCheckKey]histogram, map[decisionKey]uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	healthChecks := make(map[healthCheckKey]histogram, len(m.healthChecks))
+	for key, h := range m.healthChecks {
+		c := *h
+		c.counts = slices.Clone(h.counts)
+		healthChecks[key] = c
+	}
+	decisions := make(map[decisionKey]uint64, len(m.decisions))
+	for key, n := range m.decisions {
+		decisions[key] = n
+	}
+	return healthChecks, decisions
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	healthChecks, counts := m.snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]healthCheckKey, 0, len(healthChecks))
+	for key := range healthChecks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].backend != keys[j].backend {
+			return keys[i].backend < keys[j].backend
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	fmt.Fprintln(w, "# HELP wol_health_check_duration_seconds Duration of backend health checks.")
+	fmt.Fprintln(w, "# TYPE wol_health_check_duration_seconds histogram")
+	for _, key := range keys {
+		h := healthChecks[key]
+		labels := fmt.Sprintf("backend=%q,result=%q", key.backend, key.result)
+		var cumulative uint64
+		for i, le := range healthCheckBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "wol_health_check_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(w, "wol_health_check_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "wol_health_check_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "wol_health_check_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	decisions := make([]decisionKey, 0, len(counts))
+	for key := range counts {
+		decisions = append(decisions, key)
+	}
+	sort.Slice(decisions, func(i, j int) bool {
+		if decisions[i].backend != decisions[j].backend {
+			return decisions[i].backend < decisions[j].backend
+		}
+		return decisions[i].decision < decisions[j].decision
+	})
+
+	fmt.Fprintln(w, "# HELP wol_decision_total Wake decisions taken per backend and request.")
+	fmt.Fprintln(w, "# TYPE wol_decision_total counter")
+	for _, key := range decisions {
+		fmt.Fprintf(w, "wol_decision_total{backend=%q,decision=%q} %d\n", key.backend, key.decision, counts[key])
+	}
+}
+
+// cooldown returns how long to wait between WoL packets to backend. With
+// adaptiveCooldown it is the average observed boot time times the
+// multiplier, clamped to [cooldownMin, cooldownMax]; without boot history it
+// falls back to the fixed wakeCooldown.
+func cooldown(backend Target, bootTimes []time.Duration) time.Duration {
+	fixed := time.Duration(backend.Cooldown) * time.Second
+	if !backend.Adaptive || len(bootTimes) == 0 {
+		return fixed
+	}
+
+	var total time.Duration
+	for _, d := range bootTimes {
+		total += d
+	}
+	avg := total / time.Duration(len(bootTimes))
+	d := time.Duration(float64(avg) * backend.CooldownMult)
+	if floor := time.Duration(backend.CooldownMin) * time.Second; d < floor {
+		d = floor
+	}
+	if ceiling := time.Duration(backend.CooldownMax) * time.Second; ceiling > 0 && d > ceiling {
+		d = ceiling
+	}
+	return d
+}
+
+// startWake claims the next packet for ws and a wake slot held for hold.
+// Otherwise it returns the decision why not, and for the cooldown how long
+// ago the last packet was sent.
+func startWake(backend Target, ws *wakeState, hold time.Duration) (func(), string, time.Duration) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	now := time.Now()
+	if !ws.lastPacket.IsZero() {
+		since := now.Sub(ws.lastPacket)
+		if since < cooldown(backend, ws.bootTimes) {
+			return nil, decisionCooldown, since
+		}
+	}
+	release, ok := ws.wakes.acquire(hold)
+	if !ok {
+		return nil, decisionMaxConcurrency, 0
+	}
+	ws.lastPacket = now
+	if ws.wakeStarted.IsZero() {
+		ws.wakeStarted = now
+	}
+	return release, "", 0
+}
+
+// wake sends a WoL packet to backend unless it is within its cooldown or
+// maxConcurrentWakes wakes are already in flight for its machine, and
+// returns the resulting decision. A wake stays in flight until the backend
+// is seen online or hold passes.
+func wake(name string, backend Target, state *backendState, hold time.Duration) string {
+	release, decision, since := startWake(backend, state.wake, hold)
+	switch decision {
+	case decisionCooldown:
+		log.Printf("Backend %s woken %v ago, still within cooldown -> skipping WoL", name, since.Round(time.Second))
+		return decision
+	case decisionMaxConcurrency:
+		log.Printf("Backend %s already has %d wake(s) in flight -> skipping WoL", name, state.wake.wakes.max)
+		return decision
+	}
+
+	log.Printf("Backend %s down -> sending WoL", name)
+	if err := sendWOL(backend.MacAddress, backend.BroadcastIP, backend.WolPort); err != nil {
+		log.Printf("WOL %s failed: %v", name, err)
+		release()
+		return decisionWOLFailed
+	}
+	return decisionWoken
+}
+
+// Generations
+
+// generation is everything derived from one loaded config. Requests load the
+// current generation once when they start and use only it until they finish,
+// so a reload never changes the settings of an in-flight request: it
+// completes against the backends, timeouts and proxy of the config it
+// started with, while requests arriving after the swap see the new one.
+type generation struct {
+	cfg        *Config
+	states     map[string]*backendState
+	wakeStates map[string]*wakeState // by wakeKey
+	handler    http.Handler
+	stop       chan struct{} // closed to end background checks
+	closers    []func()      // release the transports, see retire
+
+	mu      sync.Mutex
+	active  int  // requests in flight
+	retired bool // replaced by a reload
+}
+
+var current atomic.Pointer[generation]
+
+// newGeneration builds the backend states and handler for cfg. Cached
+// online status, wake history and the in-flight wake guard of backends
+// present in prev are carried over, so a reload neither forgets which
+// backends are up nor lets extra wakes through.
+func newGeneration(cfg *Config, prev *generation) (*generation, error) {
+	names := make([]string, 0, len(cfg.Backends))
+	for name := range cfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Members of a wake group agree on maxConcurrentWakes, see checkWakeGroups
+	wakeStates := map[string]*wakeState{}
+	for _, name := range names {
+		backend := cfg.Backends[name]
+		key := wakeKey(name, backend)
+		if _, ok := wakeStates[key]; ok {
+			continue
+		}
+		ws := &wakeState{wakes: newWakeLimiter(backend.MaxWakes)}
+		if prev != nil {
+			if old, ok := prev.wakeStates[key]; ok {
+				old.mu.Lock()
+				ws.wakeStarted = old.wakeStarted
+				ws.lastPacket = old.lastPacket
+				ws.bootTimes = append([]time.Duration(nil), old.bootTimes...)
+				old.mu.Unlock()
+				if old.wakes.max == ws.wakes.max {
+					ws.wakes = old.wakes
+				}
+			}
+		}
+		wakeStates[key] = ws
+	}
+
+	var closers []func()
+	fail := func(err error) (*generation, error) {
+		for _, c := range closers {
+			c()
+		}
+		return nil, err
+	}
+	strictProxy := cfg.General.StrictReadiness && cfg.General.WakeMode == wakeModeProxy
+	states := make(map[string]*backendState, len(cfg.Backends))
+	for _, name := range names {
+		backend := cfg.Backends[name]
+		transport, closer, err := newTransport(backend.SSHJump)
+		if err != nil {
+			return fail(fmt.Errorf("backend %s: %w", name, err))
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		state := &backendState{
+			health: healthCheck{
+				name:       name,
+				client:     newHealthClient(transport),
+				url:        backend.Destination,
+				maxLatency: time.Duration(backend.MaxLatency) * time.Millisecond,
+			},
+			wake:    wakeStates[wakeKey(name, backend)],
+			proxied: strictProxy && (len(backend.Hosts) > 0 || sameOrigin(backend.Destination, cfg.General.Destination)),
+		}
+		if cfg.General.CheckInterval > 0 {
+			state.checked = make(chan struct{})
+		}
+		if prev != nil {
+			if old, ok := prev.states[name]; ok && old.health.url == state.health.url {
+				old.mu.Lock()
+				state.lastOnline = old.lastOnline
+				old.mu.Unlock()
+				// Already checked under the old config, no need to hold requests again
+				if state.checked != nil && isClosed(old.checked) {
+					close(state.checked)
+				}
+			}
+		}
+		states[name] = state
+	}
+
+	transport, closer, err := newTransport(cfg.General.SSHJump)
+	if err != nil {
+		return fail(fmt.Errorf("destination transport: %w", err))
+	}
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+	h, err := handler(cfg, states, transport)
+	if err != nil {
+		return fail(err)
+	}
+	return &generation{
+		cfg:        cfg,
+		states:     states,
+		wakeStates: wakeStates,
+		handler:    h,
+		stop:       make(chan struct{}),
+		closers:    closers,
+	}, nil
+}
+
+// acquire registers a request on gen, or reports false if gen has already
+// been retired.
+func (gen *generation) acquire() bool {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	if gen.retired {
+		return false
+	}
+	gen.active++
+	return true
+}
+
+func (gen *generation) release() {
+	gen.mu.Lock()
+	gen.active--
+	idle := gen.retired && gen.active == 0
+	gen.mu.Unlock()
+	if idle {
+		gen.closeTransports()
+	}
+}
+
+// retire stops the background checks of a replaced generation and closes
+// its transports, including SSH tunnels, once its last request finished.
+func (gen *generation) retire() {
+	close(gen.stop)
+	gen.mu.Lock()
+	gen.retired = true
+	idle := gen.active == 0
+	gen.mu.Unlock()
+	if idle {
+		gen.closeTransports()
+	}
+}
+
+func (gen *generation) closeTransports() {
+	for _, c := range gen.closers {
+		c()
+	}
+}
+
+// serveCurrent serves r with the current generation.
+func serveCurrent(w http.ResponseWriter, r *http.Request) {
+	for {
+		gen := current.Load()
+		if gen == nil || gen.handler == nil {
+			http.Error(w, "Proxy not configured", http.StatusInternalServerError)
+			return
+		}
+		// A generation is only retired after its successor is stored, so
+		// loading again picks that up
+		if gen.acquire() {
+			defer gen.release()
+			gen.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+}
+
+func isClosed(c chan struct{}) bool {
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// startChecks starts the background health checks of every backend, if
+// healthCheckInterval is set.
+func (gen *generation) startChecks() {
+	if gen.cfg.General.CheckInterval <= 0 {
+		return
+	}
+	interval := time.Duration(gen.cfg.General.CheckInterval) * time.Second
+	strict := gen.cfg.General.StrictReadiness
+	for _, state := range gen.states {
+		go func(state *backendState) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				probe(state, strict)
+				if !isClosed(state.checked) {
+					close(state.checked)
+				}
+				select {
+				case <-gen.stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(state)
+	}
+}
+
+// awaitFirstChecks holds a request until every backend has had its first
+// background health check, or wait elapses.
+func awaitFirstChecks(ctx context.Context, states map[string]*backendState, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for _, state := range states {
+		if state.checked == nil {
+			continue
+		}
+		select {
+		case <-state.checked:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restartOnly lists settings that changed between old and new but only take
+// effect on restart.
+func restartOnly(old, new General) []string {
+	var changed []string
+	if old.Listen != new.Listen || !slices.Equal(old.ListenAddresses, new.ListenAddresses) ||
+		old.ListenFailure != new.ListenFailure {
+		changed = append(changed, "listen")
+	}
+	if old.MetricsListen != new.MetricsListen {
+		changed = append(changed, "metricsListen")
+	}
+	if old.HeartbeatURL != new.HeartbeatURL || old.HeartbeatEvery != new.HeartbeatEvery {
+		changed = append(changed, "heartbeat")
+	}
+	if old.DNSRefresh != new.DNSRefresh {
+		changed = append(changed, "dnsRefreshInterval")
+	}
+	return changed
+}
+
+func reload(configFile, profile string) {
+	cfg, err := LoadConfig(configFile, profile)
+	if err != nil {
+		log.Printf("Reload failed, keeping current config: %v", err)
+		return
+	}
+	prev := current.Load()
+	next, err := newGeneration(cfg, prev)
+	if err != nil {
+		log.Printf("Reload failed, keeping current config: %v", err)
+		return
+	}
+	if changed := restartOnly(prev.cfg.General, cfg.General); len(changed) > 0 {
+		log.Printf("Reload: %s changes need a restart to take effect", strings.Join(changed, ", "))
+	}
+	current.Store(next)
+	next.startChecks()
+	prev.retire()
+
+	if dump, err := dumpConfig(cfg); err == nil {
+		log.Printf("Config reloaded:\n%s", dump)
+	}
+}
+
+// Handler
+
+// route is where a request is forwarded once its backends are awake.
+type route struct {
+	name        string // backend routing the host, "" for the [proxy] destination
+	health      healthCheck
+	proxy       http.Handler
+	redirectURL string
+}
+
+func handler(cfg *Config, states map[string]*backendState, transport http.RoundTripper) (http.HandlerFunc, error) {
+	skipTimeout := time.Duration(cfg.General.SkipCheckTimeout) * time.Second
+	wakeTimeout := time.Duration(cfg.General.WakeTimeout) * time.Second
+	strict := cfg.General.StrictReadiness
+	waitForChecks := cfg.General.CheckInterval > 0 && cfg.General.StartupMode == startupWait
+	startupWait := time.Duration(cfg.General.StartupWait) * time.Second
+	strictProxy := strict && cfg.General.WakeMode == wakeModeProxy
+
+	var bufferLimit int64
+	if cfg.General.Buffering == bufferingBuffer {
+		bufferLimit = cfg.General.BufferThreshold
+	}
+
+	// With strict readiness, backends requests are proxied to are only
+	// cached as online after a request was actually proxied to them
+	// successfully, and marked offline again when proxying fails.
+	cacheResult := func(targets []*backendState) func(ok bool) {
+		if !strictProxy {
+			return nil
+		}
+		return func(ok bool) {
+			for _, state := range targets {
+				if ok {
+					setOnline(state)
+				} else {
+					setOffline(state)
+				}
+			}
+		}
+	}
+
+	// Legacy routing: hosts containing mainHostKeyword go to the [proxy]
+	// destination
+	var mainRoute *route
+	if cfg.General.Destination != "" {
+		var targets []*backendState
+		for name, backend := range cfg.Backends {
+			if len(backend.Hosts) == 0 && states[name].proxied {
+				targets = append(targets, states[name])
+			}
+		}
+		proxy, err := makeProxy(cfg.General.Destination, transport, bufferLimit, cacheResult(targets))
+		if err != nil {
+			return nil, err
+		}
+		mainRoute = &route{
+			health: healthCheck{
+				name:       destinationName,
+				client:     newHealthClient(transport),
+				url:        cfg.General.Destination,
+				maxLatency: time.Duration(cfg.General.MaxLatency) * time.Millisecond,
+			},
+			proxy:       proxy,
+			redirectURL: cfg.General.RedirectURL,
+		}
+	}
+
+	// Backends with hosts route those hosts to themselves, checked in name
+	// order before falling back to mainHostKeyword
+	var names []string
+	for name, backend := range cfg.Backends {
+		if len(backend.Hosts) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	hostRoutes := make([]*route, 0, len(names))
+	for _, name := range names {
+		backend, state := cfg.Backends[name], states[name]
+		proxy, err := makeProxy(backend.Destination, state.health.client.Transport, bufferLimit, cacheResult([]*backendState{state}))
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+		redirectURL := backend.RedirectURL
+		if redirectURL == "" {
+			redirectURL = cfg.General.RedirectURL
+		}
+		hostRoutes = append(hostRoutes, &route{name: name, health: state.health, proxy: proxy, redirectURL: redirectURL})
+	}
+
+	routeFor := func(host string) *route {
+		h := host
+		if hn, _, err := net.SplitHostPort(host); err == nil {
+			h = hn
+		}
+		h = strings.ToLower(h)
+		for _, rt := range hostRoutes {
+			if cfg.Backends[rt.name].hosts.match(h) {
+				return rt
+			}
+		}
+		if mainRoute != nil && strings.Contains(host, cfg.General.MainHostKeyword) {
+			return mainRoute
+		}
+		return nil
+	}
+
+	// wakeDecision checks one backend and wakes it if needed. woken holds the
+	// machines already woken for this request.
+	wakeDecision := func(name string, backend Target, state *backendState, host, path string, woken map[*wakeState]bool) string {
+		if recentlyOnline(state, skipTimeout) {
+			return decisionCachedOnline
+		}
+		if (!isClosed(state.checked) || !checkedDown(state, skipTimeout)) && probe(state, strict) {
+			return decisionOnline
+		}
+		if reason := suppressWOL(backend, host, path); reason != "" {
+			return reason
+		}
+		if woken[state.wake] {
+			log.Printf("Backend %s shares wake group %q with a backend already woken -> skipping WoL", name, backend.WakeGroup)
+			return decisionWakeGroup
+		}
+		woken[state.wake] = true
+		return wake(name, backend, state, wakeTimeout)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.RemoteAddr
+		host := r.Host
+		path := r.URL.Path
+		log.Printf("[%s] Request host=%s path=%s", clientIP, host, path)
+
+		rt := routeFor(host)
+		if rt == nil {
+			io.WriteString(w, "Host does not match main backend target")
+			return
+		}
+
+		// Backends the background checker has not reached yet are checked
+		// synchronously below, in wait mode only after holding the request
+		// for their first background check. A backend background checks
+		// found down is not checked again until skipCheckTimeout passes.
+		if waitForChecks {
+			awaitFirstChecks(r.Context(), states, startupWait)
+		}
+
+		// Check backends and send WoL, at most once per machine. Backends
+		// with hosts of their own are only woken for requests routed to them.
+		woken := map[*wakeState]bool{}
+		for name, backend := range cfg.Backends {
+			if len(backend.Hosts) > 0 && name != rt.name {
+				continue
+			}
+			state := states[name]
+			metrics.countDecision(name, wakeDecision(name, backend, state, host, path, woken))
+		}
+
+		if cfg.General.WakeMode == wakeModeRedirect {
+			// Hand the client over to the destination once it is up
+			if waitHealthy(r.Context(), rt.health, wakeTimeout) {
+				http.Redirect(w, r, redirectTarget(rt.redirectURL, r), http.StatusFound)
+				return
+			}
+			http.Error(w, "Destination backend unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		rt.forward(w, r)
+	}, nil
+}
+
+// forward proxies r to the routed service, if it is up.
+func (rt *route) forward(w http.ResponseWriter, r *http.Request) {
+	if rt.proxy == nil {
+		http.Error(w, "No proxy configured for destination", http.StatusInternalServerError)
+		return
+	}
+	if rt.health.check() {
+		rt.proxy.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "Destination backend unavailable", http.StatusServiceUnavailable)
+}
+
+// Heartbeat
+
+// heartbeat POSTs to url every interval so an external monitor notices when
+// the proxy stops running. Failures are only logged.
+func heartbeat(target string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		sendHeartbeat(client, target)
+		time.Sleep(interval)
+	}
+}
+
+// sendHeartbeat POSTs once to target. The URL path may be the monitor's
+// credential, so it is redacted from the logged errors.
+func sendHeartbeat(client *http.Client, target string) {
+	resp, err := client.Post(target, "text/plain", nil)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		log.Printf("Heartbeat to %s failed: %v", redactURLPath(target), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("Heartbeat to %s failed: %s", redactURLPath(target), resp.Status)
+	}
+}
+
+// Listeners
+
+// listen binds every address. In fail-fast mode the first conflict or bind
+// error closes whatever was already bound and is returned. In best-effort
+// mode failures are logged and skipped, and only having bound nothing at all
+// is an error.
+func listen(addrs []string, mode string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	fail := func(err error) error {
+		if mode == listenBestEffort {
+			log.Printf("Skipping listener: %v", err)
+			return nil
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		if seen[addr] {
+			if err := fail(fmt.Errorf("listen address %s configured more than once", addr)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seen[addr] = true
+
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			if err := fail(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listen address could be bound")
+	}
+	return listeners, nil
+}
+
+// Main
+
+func main() {
+	printConfig := flag.Bool("print-config", false, "print the effective config (secrets redacted) and exit")
+	profile := flag.String("profile", os.Getenv(profileEnv), "config profile to merge over the base config (env "+profileEnv+")")
+	flag.Parse()
+
+	configFile := "config.toml"
+	if flag.NArg() > 0 {
+		configFile = flag.Arg(0)
+	}
+
+	cfg, err := LoadConfig(configFile, *profile)
+	if err != nil {
+		log.Fatalf("Failed to load config file: %v", err)
+	}
+
+	dump, err := dumpConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to encode config: %v", err)
+	}
+	if *printConfig {
+		fmt.Print(dump)
+		return
+	}
+	log.Printf("Effective config:\n%s", dump)
+
+	if cfg.General.DNSRefresh > 0 {
+		dnsResolver = newRefreshingResolver(time.Duration(cfg.General.DNSRefresh) * time.Second)
+		go dnsResolver.run()
+	}
+
+	gen, err := newGeneration(cfg, nil)
+	if err != nil {
+		log.Fatalf("Failed to set up backends: %v", err)
+	}
+	current.Store(gen)
+	gen.startChecks()
+
+	// SIGHUP reloads the config without dropping in-flight requests
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received, reloading %s", configFile)
+			reload(configFile, *profile)
+		}
+	}()
+
+	if cfg.General.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Printf("Metrics listening on %s", cfg.General.MetricsListen)
+			log.Fatal(http.ListenAndServe(cfg.General.MetricsListen, mux))
+		}()
+	}
+
+	if cfg.General.HeartbeatURL != "" {
+		go heartbeat(cfg.General.HeartbeatURL, time.Duration(cfg.General.HeartbeatEvery)*time.Second)
+	}
+
+	var addrs []string
+	if cfg.General.Listen != "" {
+		addrs = append(addrs, cfg.General.Listen)
+	}
+	addrs = append(addrs, cfg.General.ListenAddresses...)
+	listeners, err := listen(addrs, cfg.General.ListenFailure)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	http.HandleFunc("/", serveCurrent)
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("Proxy listening on %s", l.Addr())
+		go func(l net.Listener) {
+			errc <- http.Serve(l, nil)
+		}(l)
+	}
+	log.Fatal(<-errc)
 }
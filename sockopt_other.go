@@ -0,0 +1,8 @@
+//go:build !unix && !windows
+
+package main
+
+// setBroadcast is a no-op where sockets have no SO_BROADCAST option.
+func setBroadcast(fd uintptr) error {
+	return nil
+}